@@ -0,0 +1,163 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package statedbmigration
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+	"github.com/pkg/errors"
+)
+
+// fakeVersionedDB is a minimal in-memory statedb.VersionedDB used to test
+// Migrate/Verify against statedb's abstract interfaces, without opening a
+// ustore-backed stateustoredb handle. The package still imports
+// stateustoredb (for its provenance types), so building these tests still
+// needs the ustore bindings.
+type fakeVersionedDB struct {
+	mu        sync.Mutex
+	state     map[string]map[string]*statedb.VersionedValue
+	savepoint *version.Height
+}
+
+func newFakeVersionedDB() *fakeVersionedDB {
+	return &fakeVersionedDB{state: make(map[string]map[string]*statedb.VersionedValue)}
+}
+
+func (db *fakeVersionedDB) Open() error  { return nil }
+func (db *fakeVersionedDB) Close()       {}
+func (db *fakeVersionedDB) BytesKeySupported() bool { return false }
+
+func (db *fakeVersionedDB) ValidateKeyValue(key string, value []byte) error { return nil }
+
+func (db *fakeVersionedDB) GetState(namespace, key string) (*statedb.VersionedValue, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.state[namespace][key], nil
+}
+
+func (db *fakeVersionedDB) GetVersion(namespace, key string) (*version.Height, error) {
+	vv, err := db.GetState(namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	if vv == nil {
+		return nil, nil
+	}
+	return vv.Version, nil
+}
+
+func (db *fakeVersionedDB) GetStateMultipleKeys(namespace string, keys []string) ([]*statedb.VersionedValue, error) {
+	vals := make([]*statedb.VersionedValue, len(keys))
+	for i, k := range keys {
+		vv, _ := db.GetState(namespace, k)
+		vals[i] = vv
+	}
+	return vals, nil
+}
+
+func (db *fakeVersionedDB) GetStateRangeScanIterator(namespace, startKey, endKey string) (statedb.ResultsIterator, error) {
+	return db.GetStateRangeScanIteratorWithMetadata(namespace, startKey, endKey, nil)
+}
+
+func (db *fakeVersionedDB) GetStateRangeScanIteratorWithMetadata(namespace, startKey, endKey string, metadata map[string]interface{}) (statedb.QueryResultsIterator, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var keys []string
+	for k := range db.state[namespace] {
+		if startKey != "" && k < startKey {
+			continue
+		}
+		if endKey != "" && k >= endKey {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var results []statedb.QueryResult
+	for _, k := range keys {
+		vv := db.state[namespace][k]
+		results = append(results, &statedb.VersionedKV{
+			CompositeKey:   statedb.CompositeKey{Namespace: namespace, Key: k},
+			VersionedValue: *vv,
+		})
+	}
+	return &fakeResultsIterator{results: results}, nil
+}
+
+func (db *fakeVersionedDB) ExecuteQuery(namespace, query string) (statedb.ResultsIterator, error) {
+	return nil, errors.New("ExecuteQuery is not supported by fakeVersionedDB")
+}
+
+func (db *fakeVersionedDB) ExecuteQueryWithMetadata(namespace, query string, metadata map[string]interface{}) (statedb.QueryResultsIterator, error) {
+	return nil, errors.New("ExecuteQueryWithMetadata is not supported by fakeVersionedDB")
+}
+
+func (db *fakeVersionedDB) ApplyUpdates(batch *statedb.UpdateBatch, height *version.Height) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, ns := range batch.GetUpdatedNamespaces() {
+		if db.state[ns] == nil {
+			db.state[ns] = make(map[string]*statedb.VersionedValue)
+		}
+		for k, vv := range batch.GetUpdates(ns) {
+			db.state[ns][k] = vv
+		}
+	}
+	db.savepoint = height
+	return nil
+}
+
+func (db *fakeVersionedDB) GetLatestSavePoint() (*version.Height, error) {
+	return db.savepoint, nil
+}
+
+type fakeResultsIterator struct {
+	results []statedb.QueryResult
+	pos     int
+}
+
+func (itr *fakeResultsIterator) Next() (statedb.QueryResult, error) {
+	if itr.pos >= len(itr.results) {
+		return nil, nil
+	}
+	res := itr.results[itr.pos]
+	itr.pos++
+	return res, nil
+}
+
+func (itr *fakeResultsIterator) Close() { itr.pos = len(itr.results) }
+
+func (itr *fakeResultsIterator) GetBookmarkAndClose() string {
+	bookmark := ""
+	if len(itr.results) > 0 {
+		bookmark = itr.results[len(itr.results)-1].(*statedb.VersionedKV).Key
+	}
+	itr.Close()
+	return bookmark
+}
+
+// fakeProvider is a minimal in-memory statedb.VersionedDBProvider backed by
+// fakeVersionedDB handles, keyed by dbName.
+type fakeProvider struct {
+	dbs map[string]*fakeVersionedDB
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{dbs: make(map[string]*fakeVersionedDB)}
+}
+
+func (p *fakeProvider) GetDBHandle(dbName string) (statedb.VersionedDB, error) {
+	if p.dbs[dbName] == nil {
+		p.dbs[dbName] = newFakeVersionedDB()
+	}
+	return p.dbs[dbName], nil
+}
+
+func (p *fakeProvider) Close() {}
@@ -0,0 +1,285 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package statedbmigration implements the engine behind a `peer node
+// rebuild-statedb --from <backend> --to <backend>` style subcommand: it
+// walks every namespace of a source statedb.VersionedDBProvider at its
+// latest savepoint and replays the (key, version, value) triples into a
+// destination provider via ApplyUpdates, the same entry point normal block
+// commit uses.
+//
+// This package only depends on the statedb.VersionedDBProvider/VersionedDB
+// interfaces, so it works for any pair of registered backends (ustoredb,
+// couchdb, leveldb, ...); it does not itself wire up the `peer node
+// rebuild-statedb` CLI flags, which belongs in the peer command tree
+// alongside the other `peer node` subcommands.
+package statedbmigration
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+
+	"github.com/hyperledger/fabric/common/flogging"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb/stateustoredb"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+	"github.com/pkg/errors"
+)
+
+var logger = flogging.MustGetLogger("statedbmigration")
+
+// defaultBatchSize matches the block sizes migration is typically run
+// against; callers can override it through Options.BatchSize.
+const defaultBatchSize = 1000
+
+// Options configures a single Migrate call.
+type Options struct {
+	// Namespaces lists the chaincode namespaces to migrate. statedb has no
+	// namespace-enumeration API of its own (namespaces are tracked by the
+	// ledger's channel config), so the caller must supply them.
+	Namespaces []string
+	// BatchSize bounds how many keys accumulate in one ApplyUpdates call.
+	// Defaults to defaultBatchSize when zero.
+	BatchSize int
+	// ResumeFrom resumes a previously interrupted migration: namespaces
+	// before ResumeFrom.Namespace are skipped entirely, and the named
+	// namespace resumes scanning strictly after ResumeFrom.Key, which a
+	// prior run's Report.LastBookmark only ever points at a key that was
+	// itself successfully committed to the destination.
+	ResumeFrom Bookmark
+	// ProvenanceSidecar, when non-nil, receives one JSON-encoded
+	// sidecarEntry line (namespace, key, and the Hist/Backward/Forward
+	// results at the savepoint) per migrated key whenever the source implements
+	// stateustoredb.ProvenanceQuerier and the destination cannot store
+	// provenance natively (i.e. is not itself a ProvenanceWriter).
+	ProvenanceSidecar io.Writer
+}
+
+// Bookmark marks a position a crashed migration can restart from without
+// re-writing keys that already made it to the destination.
+type Bookmark struct {
+	Namespace string
+	Key       string
+}
+
+// Report summarizes a completed (or verified) migration.
+type Report struct {
+	KeysMigrated   int
+	LastBookmark   Bookmark
+	MismatchedKeys []string // only populated when Verify finds a divergence
+}
+
+// Migrate copies every key of dbName from src to dst at src's latest
+// savepoint, batching writes and recording a resumable Bookmark as it goes.
+func Migrate(src, dst statedb.VersionedDBProvider, dbName string, opts Options) (*Report, error) {
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	srcDB, err := src.GetDBHandle(dbName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Fail to open source db "+dbName)
+	}
+	dstDB, err := dst.GetDBHandle(dbName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Fail to open destination db "+dbName)
+	}
+	savepoint, err := srcDB.GetLatestSavePoint()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Fail to read source savepoint for "+dbName)
+	}
+
+	provQuerier, _ := srcDB.(stateustoredb.ProvenanceQuerier)
+	_, dstHasProvenance := dstDB.(stateustoredb.ProvenanceWriter)
+
+	report := &Report{}
+	resuming := opts.ResumeFrom.Namespace != ""
+	for _, ns := range opts.Namespaces {
+		if resuming && ns != opts.ResumeFrom.Namespace {
+			continue
+		}
+		startKey := ""
+		resumeExclusive := false
+		if resuming && ns == opts.ResumeFrom.Namespace {
+			startKey = opts.ResumeFrom.Key
+			resumeExclusive = true
+			resuming = false
+		}
+
+		if err := migrateNamespace(srcDB, dstDB, ns, startKey, resumeExclusive, batchSize, savepoint, provQuerier, dstHasProvenance, opts.ProvenanceSidecar, report); err != nil {
+			return report, err
+		}
+	}
+	logger.Infof("Migrated %d keys for db %s up to savepoint %d", report.KeysMigrated, dbName, savepoint.BlockNum)
+	return report, nil
+}
+
+// migrateNamespace scans ns starting at startKey and replays it into dstDB
+// in batches of batchSize. When resumeExclusive is set, startKey is the
+// Bookmark a prior, interrupted run last reported -- which was already
+// committed to dstDB -- so the first key GetStateRangeScanIterator returns
+// (startKey is otherwise inclusive) is skipped rather than re-migrated.
+func migrateNamespace(srcDB, dstDB statedb.VersionedDB, ns, startKey string, resumeExclusive bool, batchSize int, savepoint *version.Height,
+	provQuerier stateustoredb.ProvenanceQuerier, dstHasProvenance bool, sidecar io.Writer, report *Report) error {
+	itr, err := srcDB.GetStateRangeScanIterator(ns, startKey, "")
+	if err != nil {
+		return errors.WithMessage(err, "Fail to scan namespace "+ns)
+	}
+	defer itr.Close()
+
+	batch := statedb.NewUpdateBatch()
+	pending := 0
+	haveBookmark := false
+	var pendingBookmark Bookmark
+	skipResumeKey := resumeExclusive
+	for {
+		queryResult, err := itr.Next()
+		if err != nil {
+			return errors.WithMessage(err, "Fail to read next key in namespace "+ns)
+		}
+		if queryResult == nil {
+			break
+		}
+		kv := queryResult.(*statedb.VersionedKV)
+		if skipResumeKey {
+			skipResumeKey = false
+			if kv.Key == startKey {
+				continue
+			}
+		}
+		batch.Update(kv.Namespace, kv.Key, &kv.VersionedValue)
+		pending++
+		// LastBookmark only advances once this key's batch has actually been
+		// committed to dstDB (below), never on read: advancing it here would
+		// let a crash between this read and the next ApplyUpdates leave a
+		// bookmark past keys that were never written to the destination, and
+		// a resume would then skip them instead of retrying them.
+		pendingBookmark = Bookmark{Namespace: ns, Key: kv.Key}
+		haveBookmark = true
+
+		if provQuerier != nil && !dstHasProvenance && sidecar != nil {
+			if err := writeSidecarEntry(sidecar, ns, kv.Key, savepoint.BlockNum, provQuerier); err != nil {
+				return err
+			}
+		}
+
+		if pending >= batchSize {
+			if err := dstDB.ApplyUpdates(batch, savepoint); err != nil {
+				return errors.WithMessage(err, "Fail to apply migrated batch for namespace "+ns)
+			}
+			report.KeysMigrated += pending
+			if haveBookmark {
+				report.LastBookmark = pendingBookmark
+			}
+			batch = statedb.NewUpdateBatch()
+			pending = 0
+		}
+	}
+	if pending > 0 {
+		if err := dstDB.ApplyUpdates(batch, savepoint); err != nil {
+			return errors.WithMessage(err, "Fail to apply final migrated batch for namespace "+ns)
+		}
+		report.KeysMigrated += pending
+		report.LastBookmark = pendingBookmark
+	}
+	return nil
+}
+
+// sidecarEntry is the on-disk shape written for keys whose provenance the
+// destination backend has no native way to store.
+type sidecarEntry struct {
+	Namespace string
+	Key       string
+	Hist      *stateustoredb.HistResult     `json:",omitempty"`
+	Backward  *stateustoredb.BackwardResult `json:",omitempty"`
+	Forward   *stateustoredb.ForwardResult  `json:",omitempty"`
+}
+
+func writeSidecarEntry(w io.Writer, ns, key string, atBlock uint64, q stateustoredb.ProvenanceQuerier) error {
+	hist, err := q.HistoricalValue(ns, key, atBlock)
+	if err != nil {
+		return errors.WithMessage(err, "Fail to read provenance history for "+ns+"#"+key)
+	}
+	backward, err := q.BackwardDeps(ns, key, atBlock)
+	if err != nil {
+		return errors.WithMessage(err, "Fail to read provenance backward deps for "+ns+"#"+key)
+	}
+	forward, err := q.ForwardDeps(ns, key, atBlock)
+	if err != nil {
+		return errors.WithMessage(err, "Fail to read provenance forward deps for "+ns+"#"+key)
+	}
+	entry := sidecarEntry{Namespace: ns, Key: key, Hist: hist, Backward: backward, Forward: forward}
+	enc, err := json.Marshal(entry)
+	if err != nil {
+		return errors.WithMessage(err, "Fail to marshal sidecar entry for "+ns+"#"+key)
+	}
+	if _, err := w.Write(append(enc, '\n')); err != nil {
+		return errors.WithMessage(err, "Fail to write sidecar entry for "+ns+"#"+key)
+	}
+	return nil
+}
+
+// Verify re-reads dst and compares a SHA-256 digest of every (ns, key, ver,
+// val) tuple against src, reporting any key whose digest diverges.
+func Verify(src, dst statedb.VersionedDBProvider, dbName string, namespaces []string) (*Report, error) {
+	srcDB, err := src.GetDBHandle(dbName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Fail to open source db "+dbName)
+	}
+	dstDB, err := dst.GetDBHandle(dbName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Fail to open destination db "+dbName)
+	}
+
+	report := &Report{}
+	for _, ns := range namespaces {
+		if err := verifyNamespace(srcDB, dstDB, ns, report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func verifyNamespace(srcDB, dstDB statedb.VersionedDB, ns string, report *Report) error {
+	srcItr, err := srcDB.GetStateRangeScanIterator(ns, "", "")
+	if err != nil {
+		return errors.WithMessage(err, "Fail to scan source namespace "+ns)
+	}
+	defer srcItr.Close()
+
+	for {
+		queryResult, err := srcItr.Next()
+		if err != nil {
+			return errors.WithMessage(err, "Fail to read next source key in namespace "+ns)
+		}
+		if queryResult == nil {
+			break
+		}
+		kv := queryResult.(*statedb.VersionedKV)
+		dstVV, err := dstDB.GetState(ns, kv.Key)
+		if err != nil {
+			return errors.WithMessage(err, "Fail to read destination key "+ns+"#"+kv.Key)
+		}
+		report.KeysMigrated++
+		if dstVV == nil || digest(dstVV) != digest(&kv.VersionedValue) {
+			report.MismatchedKeys = append(report.MismatchedKeys, ns+"#"+kv.Key)
+		}
+	}
+	return nil
+}
+
+func digest(vv *statedb.VersionedValue) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(vv.Value)
+	if vv.Version != nil {
+		verBytes, _ := json.Marshal(vv.Version)
+		h.Write(verBytes)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
@@ -0,0 +1,119 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package stateustoredb
+
+import (
+	"math"
+	"time"
+	"ustore"
+
+	"github.com/pkg/errors"
+)
+
+// defaultBatchSize and defaultMaxBatchBytes bound a single ustore.WriteBatch
+// when a VersionedDBProvider is constructed with NewVersionedDBProvider
+// instead of explicit tunables.
+const (
+	defaultBatchSize     = 1000
+	defaultMaxBatchBytes = 4 * 1024 * 1024
+)
+
+// writeBatchEntry captures one key's PutState arguments so a whole block's
+// worth of writes can be accumulated in Go before crossing the cgo/SWIG
+// boundary once per sub-batch instead of once per key. An entry with
+// isDelete set carries nothing but compositeKey; it represents a stale
+// inverted-index row (see query.go's indexMaintenanceEntries) that must be
+// removed from the same sub-batch the new rows are added in.
+type writeBatchEntry struct {
+	compositeKey    string
+	val             string
+	txnID           string
+	blk             uint64
+	deps            []string
+	snapshotVersion string
+	isDelete        bool
+}
+
+func (vdb *versionedDB) newWriteBatchEntry(ns, key string, val []byte, blk uint64, entry ProvEntry) writeBatchEntry {
+	deps := make([]string, 0, len(entry.Deps))
+	for _, dep := range entry.Deps {
+		deps = append(deps, constructCompositeKey(dep.Namespace, dep.Key))
+	}
+	txnID := entry.TxnID
+	if txnID == "" {
+		txnID = "faketxnid" // ustore rejects an empty txnID
+	}
+	snapshotVersion := ""
+	if entry.Snapshot != math.MaxUint64 {
+		snapshotVersion = vdb.snapshotVersions[entry.Snapshot]
+	}
+	return writeBatchEntry{
+		compositeKey:    constructCompositeKey(ns, key),
+		val:             string(val),
+		txnID:           txnID,
+		blk:             blk,
+		deps:            deps,
+		snapshotVersion: snapshotVersion,
+	}
+}
+
+// size estimates the on-the-wire footprint of entry, used to keep a
+// sub-batch under MaxBatchBytes.
+func (e writeBatchEntry) size() int {
+	n := len(e.compositeKey) + len(e.val) + len(e.txnID) + len(e.snapshotVersion)
+	for _, dep := range e.deps {
+		n += len(dep)
+	}
+	return n
+}
+
+// applyEntries submits entries to ustore as one or more ustore.WriteBatch
+// calls, each bounded by vdb.batchSize keys and vdb.maxBatchBytes bytes; a
+// single entry larger than vdb.maxBatchBytes still goes into a sub-batch of
+// its own.
+// Splitting only changes how many cgo calls are made; the resulting state
+// is still only made visible by the single Commit() ApplyUpdates issues
+// after applyEntries returns, so a block's writes still land under one
+// snapshot version regardless of how many sub-batches it took.
+func (vdb *versionedDB) applyEntries(entries []writeBatchEntry) error {
+	batchSize := vdb.batchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	maxBytes := vdb.maxBatchBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBatchBytes
+	}
+
+	for start := 0; start < len(entries); {
+		wb := ustore.NewWriteBatch()
+		size, count := 0, 0
+		end := start
+		for end < len(entries) && count < batchSize && (count == 0 || size+entries[end].size() <= maxBytes) {
+			entry := entries[end]
+			if entry.isDelete {
+				wb.Delete(entry.compositeKey)
+			} else {
+				depList := ustore.NewVecStr()
+				for _, dep := range entry.deps {
+					depList.Add(dep)
+				}
+				wb.Put(entry.compositeKey, entry.val, entry.txnID, entry.blk, depList, entry.snapshotVersion)
+			}
+			size += entry.size()
+			count++
+			end++
+		}
+
+		startPut := time.Now()
+		if status := vdb.udb.ApplyBatch(wb); !status.Ok() {
+			return errors.New("Fail to apply write batch with status " + status.ToString())
+		}
+		logger.Infof("[udb] Applied write batch of %d keys (%d bytes) in %d us", count, size, time.Since(startPut).Nanoseconds()/1000)
+		start = end
+	}
+	return nil
+}
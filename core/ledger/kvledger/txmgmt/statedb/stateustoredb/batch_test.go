@@ -0,0 +1,81 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package stateustoredb
+
+import (
+	"fmt"
+	"testing"
+
+	"ustore"
+)
+
+func benchEntries(n int) []writeBatchEntry {
+	entries := make([]writeBatchEntry, n)
+	for i := 0; i < n; i++ {
+		entries[i] = writeBatchEntry{
+			compositeKey: fmt.Sprintf("ns1#key-%d", i),
+			val:          fmt.Sprintf("val-%d", i),
+			txnID:        "benchtxn",
+			blk:          1,
+		}
+	}
+	return entries
+}
+
+// benchmarkPerKey submits entries one ApplyBatch call at a time, the way
+// ApplyUpdates worked before batch.go coalesced a block's writes.
+func benchmarkPerKey(b *testing.B, n int) {
+	vdb := newVersionedDB(ustore.NewKVDB(), "benchdb", 1, 0)
+	if err := vdb.Open(); err != nil {
+		b.Fatal(err)
+	}
+	entries := benchEntries(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, entry := range entries {
+			if err := vdb.applyEntries([]writeBatchEntry{entry}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// benchmarkBatched submits the same entries coalesced into defaultBatchSize
+// sub-batches via applyEntries.
+func benchmarkBatched(b *testing.B, n int) {
+	vdb := newVersionedDB(ustore.NewKVDB(), "benchdb", defaultBatchSize, defaultMaxBatchBytes)
+	if err := vdb.Open(); err != nil {
+		b.Fatal(err)
+	}
+	entries := benchEntries(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := vdb.applyEntries(entries); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkApplyEntriesPerKey100(b *testing.B)    { benchmarkPerKey(b, 100) }
+func BenchmarkApplyEntriesPerKey1000(b *testing.B)   { benchmarkPerKey(b, 1000) }
+func BenchmarkApplyEntriesPerKey10000(b *testing.B)  { benchmarkPerKey(b, 10000) }
+func BenchmarkApplyEntriesBatched100(b *testing.B)   { benchmarkBatched(b, 100) }
+func BenchmarkApplyEntriesBatched1000(b *testing.B)  { benchmarkBatched(b, 1000) }
+func BenchmarkApplyEntriesBatched10000(b *testing.B) { benchmarkBatched(b, 10000) }
+
+func TestWriteBatchEntrySize(t *testing.T) {
+	e := writeBatchEntry{
+		compositeKey:    "ns1#key1",
+		val:             "value",
+		txnID:           "txn1",
+		snapshotVersion: "v1",
+		deps:            []string{"ns1#dep1", "ns1#dep2"},
+	}
+	want := len("ns1#key1") + len("value") + len("txn1") + len("v1") + len("ns1#dep1") + len("ns1#dep2")
+	if got := e.size(); got != want {
+		t.Fatalf("size() = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package stateustoredb
+
+import (
+	"ustore"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+	"github.com/pkg/errors"
+)
+
+// kvScanner iterates over a ustore range and decodes each composite key
+// back into the (namespace, key) pair expected by statedb consumers.
+type kvScanner struct {
+	namespace            string
+	dbItr                ustore.RangeIterator
+	requestedLimit       int32
+	totalRecordsReturned int32
+}
+
+func newKVScanner(namespace string, dbItr ustore.RangeIterator, requestedLimit int32) *kvScanner {
+	return &kvScanner{namespace, dbItr, requestedLimit, 0}
+}
+
+// Next implements method in statedb.ResultsIterator interface
+func (scanner *kvScanner) Next() (statedb.QueryResult, error) {
+	if scanner.requestedLimit > 0 && scanner.totalRecordsReturned >= scanner.requestedLimit {
+		return nil, nil
+	}
+	if !scanner.dbItr.Valid() {
+		return nil, nil
+	}
+	if status := scanner.dbItr.Status(); !status.Ok() {
+		return nil, errors.New("Fail to scan range with status " + status.ToString())
+	}
+
+	compositeKey := scanner.dbItr.Key()
+	_, key := splitCompositeKey(compositeKey)
+	val := []byte(scanner.dbItr.Value())
+	ver := version.NewHeight(scanner.dbItr.Blk_idx(), 0)
+
+	scanner.dbItr.Next()
+	scanner.totalRecordsReturned++
+
+	return &statedb.VersionedKV{
+		CompositeKey:   statedb.CompositeKey{Namespace: scanner.namespace, Key: key},
+		VersionedValue: statedb.VersionedValue{Version: ver, Value: val, Metadata: nil},
+	}, nil
+}
+
+// Close implements method in statedb.ResultsIterator interface
+func (scanner *kvScanner) Close() {
+	scanner.dbItr.Close()
+}
+
+// GetBookmarkAndClose implements method in statedb.QueryResultsIterator interface
+func (scanner *kvScanner) GetBookmarkAndClose() string {
+	retval := ""
+	if scanner.dbItr.Valid() {
+		_, retval = splitCompositeKey(scanner.dbItr.Key())
+	}
+	scanner.Close()
+	return retval
+}
@@ -0,0 +1,151 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package stateustoredb
+
+// KeyRef identifies a single versioned key that another key depends on.
+type KeyRef struct {
+	Namespace string
+	Key       string
+}
+
+// ProvEntry carries the provenance metadata that, prior to this file,
+// was smuggled into ApplyUpdates as synthetic "_prov"/"_txnID"/"_snapshot"
+// sibling keys in the same update batch.
+type ProvEntry struct {
+	TxnID    string
+	Deps     []KeyRef
+	Snapshot uint64
+}
+
+// HistResult is the typed result of a HistoricalValue lookup. Msg carries
+// the ustore status string when the query failed for a reason other than
+// not-found (Found is also false in that case); it exists so the
+// "_hist" GetSnapshotState adapter (see stateustoredb.go) can surface it
+// through shim.HistResult.Msg the same way it always has, instead of
+// turning a query failure into a hard GetState error.
+type HistResult struct {
+	Found      bool
+	Value      []byte
+	CreatedBlk uint64
+	Msg        string
+}
+
+// DepRef is one entry of a BackwardResult or ForwardResult dependency list.
+type DepRef struct {
+	Key    KeyRef
+	BlkIdx uint64
+	// TxnID is only populated for forward dependencies; ustore's Backward
+	// query reports a single owning TxnID for the queried key instead.
+	TxnID string
+}
+
+// BackwardResult is the typed result of a BackwardDeps lookup: the keys (and
+// the block at which they were read) that produced the value committed for
+// (ns, key) at blk. Msg mirrors HistResult.Msg.
+type BackwardResult struct {
+	Found bool
+	TxnID string
+	Deps  []DepRef
+	Msg   string
+}
+
+// ForwardResult is the typed result of a ForwardDeps lookup: the keys whose
+// values were derived, at or after blk, from (ns, key). Msg mirrors
+// HistResult.Msg.
+type ForwardResult struct {
+	Found bool
+	Deps  []DepRef
+	Msg   string
+}
+
+// ProvenanceQuerier exposes ustore's historical-value and dependency-graph
+// queries as typed methods instead of the `_hist`/`_backward`/`_forward`
+// key-suffix convention that GetSnapshotState historically relied on.
+type ProvenanceQuerier interface {
+	HistoricalValue(ns, key string, blk uint64) (*HistResult, error)
+	BackwardDeps(ns, key string, blk uint64) (*BackwardResult, error)
+	ForwardDeps(ns, key string, blk uint64) (*ForwardResult, error)
+}
+
+// ProvenanceWriter lets a caller attach a structured ProvEntry to a write
+// instead of stashing it under `_prov`/`_txnID`/`_snapshot` sibling keys in
+// an update batch.
+type ProvenanceWriter interface {
+	RecordProvenance(ns, key string, val []byte, blk uint64, entry ProvEntry) error
+}
+
+// HistoricalValue implements ProvenanceQuerier. It returns Found=false with
+// a non-empty Msg, rather than an error, when the underlying ustore query
+// fails for a reason other than not-found -- callers that go through the
+// legacy "_hist" GetSnapshotState adapter rely on this to get back a
+// shim.HistResult{Msg: ...} instead of a GetState-level error.
+func (vdb *versionedDB) HistoricalValue(ns, key string, blk uint64) (*HistResult, error) {
+	compositeKey := constructCompositeKey(ns, key)
+	histReturn := vdb.udb.Hist(compositeKey, blk)
+	status := histReturn.Status()
+	if status.IsNotFound() {
+		return &HistResult{Found: false}, nil
+	}
+	if !status.Ok() {
+		logger.Infof("[udb] Fail to query historical value for key %s with status %s", compositeKey, status.ToString())
+		return &HistResult{Found: false, Msg: status.ToString()}, nil
+	}
+	return &HistResult{Found: true, Value: []byte(histReturn.Value()), CreatedBlk: histReturn.Blk_idx()}, nil
+}
+
+// BackwardDeps implements ProvenanceQuerier. See HistoricalValue for the
+// Found=false/Msg contract on a query failure.
+func (vdb *versionedDB) BackwardDeps(ns, key string, blk uint64) (*BackwardResult, error) {
+	compositeKey := constructCompositeKey(ns, key)
+	backReturn := vdb.udb.Backward(compositeKey, blk)
+	status := backReturn.Status()
+	if status.IsNotFound() {
+		return &BackwardResult{Found: false}, nil
+	}
+	if !status.Ok() {
+		logger.Infof("[udb] Fail to query backward dependencies for key %s with status %s", compositeKey, status.ToString())
+		return &BackwardResult{Found: false, Msg: status.ToString()}, nil
+	}
+	deps := make([]DepRef, 0, backReturn.Dep_keys().Size())
+	for i := 0; i < int(backReturn.Dep_keys().Size()); i++ {
+		depNs, depKey := splitCompositeKey(backReturn.Dep_keys().Get(i))
+		deps = append(deps, DepRef{Key: KeyRef{Namespace: depNs, Key: depKey}, BlkIdx: backReturn.Dep_blk_idx().Get(i)})
+	}
+	return &BackwardResult{Found: true, TxnID: backReturn.TxnID(), Deps: deps}, nil
+}
+
+// ForwardDeps implements ProvenanceQuerier. See HistoricalValue for the
+// Found=false/Msg contract on a query failure.
+func (vdb *versionedDB) ForwardDeps(ns, key string, blk uint64) (*ForwardResult, error) {
+	compositeKey := constructCompositeKey(ns, key)
+	forwardReturn := vdb.udb.Forward(compositeKey, blk)
+	status := forwardReturn.Status()
+	if status.IsNotFound() {
+		return &ForwardResult{Found: false}, nil
+	}
+	if !status.Ok() {
+		logger.Infof("[udb] Fail to query forward dependencies for key %s with status %s", compositeKey, status.ToString())
+		return &ForwardResult{Found: false, Msg: status.ToString()}, nil
+	}
+	deps := make([]DepRef, 0, forwardReturn.Forward_keys().Size())
+	for i := 0; i < int(forwardReturn.Forward_keys().Size()); i++ {
+		depNs, depKey := splitCompositeKey(forwardReturn.Forward_keys().Get(i))
+		deps = append(deps, DepRef{
+			Key:    KeyRef{Namespace: depNs, Key: depKey},
+			BlkIdx: forwardReturn.Forward_blk_idx().Get(i),
+			TxnID:  forwardReturn.TxnIDs().Get(i),
+		})
+	}
+	return &ForwardResult{Found: true, Deps: deps}, nil
+}
+
+// RecordProvenance implements ProvenanceWriter. It translates entry into a
+// writeBatchEntry through newWriteBatchEntry (see batch.go), the same helper
+// ApplyUpdates uses, so callers outside of ApplyUpdates never need to know
+// about ustore.VecStr or ustore.WriteBatch.
+func (vdb *versionedDB) RecordProvenance(ns, key string, val []byte, blk uint64, entry ProvEntry) error {
+	return vdb.applyEntries([]writeBatchEntry{vdb.newWriteBatchEntry(ns, key, val, blk, entry)})
+}
@@ -0,0 +1,468 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package stateustoredb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/pkg/errors"
+)
+
+// indexNamespace prefixes every inverted-index entry with a byte that can
+// never appear in a chaincode namespace, so an index entry can never be
+// confused with real state.
+const indexNamespace = "\x01idx"
+
+// richQuery is the subset of the Mango selector dialect statecouchdb
+// accepts that this package understands: {"selector": {...}, "fields":
+// [...], "sort": [...], "limit": N, "bookmark": "..."}. Selectors are
+// limited to an implicit AND of top-level field predicates (equality or
+// one of $eq/$ne/$gt/$gte/$lt/$lte); nested boolean operators such as
+// $and/$or/$not are not recognized: such a key is compared against the
+// document as if it were a field name, so the operator itself is never
+// applied. Sort is limited to the plain
+// `["field1", "field2"]` ascending-only form of the Mango sort syntax, not
+// the `[{"field": "desc"}]` direction form.
+type richQuery struct {
+	Selector map[string]interface{} `json:"selector"`
+	Fields   []string               `json:"fields,omitempty"`
+	Sort     []string               `json:"sort,omitempty"`
+	Limit    int32                  `json:"limit,omitempty"`
+	Bookmark string                 `json:"bookmark,omitempty"`
+}
+
+// DeclareIndexedFields registers the fields that ApplyUpdates should
+// maintain inverted indexes for in namespace ns. Chaincode declares these
+// through META-INF/statedb/ustoredb/indexes/*.json, mirroring the couchdb
+// convention: the chaincode install/instantiate path is expected to call
+// ParseIndexDefinitions against that extracted directory and pass the
+// result here, alongside statecouchdb's ProcessIndexesForChaincodeDeploy.
+// This fork has no core/scc/lscc (or lifecycle) package to wire that call
+// into, so DeclareIndexedFields and ParseIndexDefinitions are provided as
+// the two halves of that integration for whichever package owns chaincode
+// deploy to call.
+func (vdb *versionedDB) DeclareIndexedFields(ns string, fields []string) {
+	if vdb.indexedFields == nil {
+		vdb.indexedFields = make(map[string][]string)
+	}
+	vdb.indexedFields[ns] = fields
+}
+
+// indexDefinition mirrors the subset of statecouchdb's
+// META-INF/statedb/couchdb/indexes/*.json schema this package understands
+// for its own META-INF/statedb/ustoredb/indexes/*.json convention:
+// {"index": {"fields": [...]}, ...}. Other keys such as "ddoc" and "name"
+// are accepted (via json.Unmarshal's default ignore-unknown-fields
+// behavior) but unused, since this package indexes by field name alone.
+type indexDefinition struct {
+	Index struct {
+		Fields []string `json:"fields"`
+	} `json:"index"`
+}
+
+// ParseIndexDefinitions reads every *.json file in indexesDir -- a
+// chaincode package's extracted META-INF/statedb/ustoredb/indexes/
+// directory -- and returns the union of every "index.fields" entry they
+// declare, in first-seen order with duplicates removed. The caller passes
+// the result to DeclareIndexedFields once per chaincode namespace.
+func ParseIndexDefinitions(indexesDir string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(indexesDir, "*.json"))
+	if err != nil {
+		return nil, errors.WithMessage(err, "Fail to list index definitions in "+indexesDir)
+	}
+
+	seen := map[string]bool{}
+	var fields []string
+	for _, path := range matches {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Fail to read index definition "+path)
+		}
+		var def indexDefinition
+		if err := json.Unmarshal(raw, &def); err != nil {
+			return nil, errors.WithMessage(err, "Fail to parse index definition "+path)
+		}
+		for _, field := range def.Index.Fields {
+			if !seen[field] {
+				seen[field] = true
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields, nil
+}
+
+// indexMaintenanceEntries returns the writeBatchEntry set that keeps ns's
+// inverted indexes in sync with key being overwritten to newVal (newVal is
+// nil/empty for a delete): a delete entry for every indexed field's old
+// `\x01idx#...` row whose value changed or disappeared, and a put entry
+// for every indexed field newVal (once unmarshaled as a JSON object) has a
+// value for. It consults the value already committed for (ns, key) via
+// GetState, which ApplyUpdates can still do here because this runs before
+// the batch built from its return value is applied.
+func (vdb *versionedDB) indexMaintenanceEntries(ns, key string, newVal []byte) []writeBatchEntry {
+	fields := vdb.indexedFields[ns]
+	if len(fields) == 0 {
+		return nil
+	}
+
+	oldFields := map[string]interface{}{}
+	if oldVV, err := vdb.GetState(ns, key); err == nil && oldVV != nil {
+		var oldDoc map[string]interface{}
+		if json.Unmarshal(oldVV.Value, &oldDoc) == nil {
+			for _, field := range fields {
+				if v, ok := oldDoc[field]; ok {
+					oldFields[field] = v
+				}
+			}
+		}
+	}
+
+	var newDoc map[string]interface{}
+	hasNewDoc := len(newVal) > 0 && json.Unmarshal(newVal, &newDoc) == nil
+
+	return indexMaintenanceEntriesCore(ns, key, fields, oldFields, newDoc, hasNewDoc)
+}
+
+// indexMaintenanceEntriesCore is the pure diffing logic behind
+// indexMaintenanceEntries: given the old and new indexed-field values
+// already pulled out of their respective documents, it decides which
+// `\x01idx#...` rows must be deleted (a field's old value disappeared or
+// changed) and which must be put (a field now has a value it didn't have,
+// or a different one). Pulling this out of indexMaintenanceEntries lets the
+// index-maintenance decision be unit tested without the cgo-only ustore
+// GetState call that produces oldFields.
+func indexMaintenanceEntriesCore(ns, key string, fields []string, oldFields, newDoc map[string]interface{}, hasNewDoc bool) []writeBatchEntry {
+	var entries []writeBatchEntry
+	for _, field := range fields {
+		oldFieldVal, hadOld := oldFields[field]
+		var newFieldVal interface{}
+		hasNew := false
+		if hasNewDoc {
+			newFieldVal, hasNew = newDoc[field]
+		}
+		if hadOld && (!hasNew || fmt.Sprint(oldFieldVal) != fmt.Sprint(newFieldVal)) {
+			entries = append(entries, writeBatchEntry{compositeKey: indexKey(ns, field, oldFieldVal, key), isDelete: true})
+		}
+		if hasNew && (!hadOld || fmt.Sprint(oldFieldVal) != fmt.Sprint(newFieldVal)) {
+			entries = append(entries, writeBatchEntry{
+				compositeKey: indexKey(ns, field, newFieldVal, key),
+				val:          key,
+				txnID:        "faketxnid",
+			})
+		}
+	}
+	return entries
+}
+
+// indexKey builds the `\x01idx#ns#field#len(value):value#key` composite key
+// described in the indexing design: value and key both live in the key so a
+// range scan over a fixed (ns, field, value) prefix finds every key with
+// that value without reading any index value back. value is length-prefixed
+// (rather than simply `#`-joined with key) so that a value containing `#`
+// can't be split two different ways -- indexKey(ns,f,"a#b","k") and
+// indexKey(ns,f,"a","b#k") would otherwise collide on the same composite
+// key -- and so indexPrefix's scan for one value can't also match rows
+// whose longer value merely shares that prefix.
+func indexKey(ns, field string, value interface{}, key string) string {
+	valStr := fmt.Sprint(value)
+	return fmt.Sprintf("%s#%s#%s#%d:%s#%s", indexNamespace, ns, field, len(valStr), valStr, key)
+}
+
+func indexPrefix(ns, field string, value interface{}) string {
+	valStr := fmt.Sprint(value)
+	return fmt.Sprintf("%s#%s#%s#%d:%s#", indexNamespace, ns, field, len(valStr), valStr)
+}
+
+// ExecuteQuery implements method in VersionedDB interface
+func (vdb *versionedDB) ExecuteQuery(namespace, query string) (statedb.ResultsIterator, error) {
+	return vdb.ExecuteQueryWithMetadata(namespace, query, nil)
+}
+
+// ExecuteQueryWithMetadata implements method in VersionedDB interface. It
+// parses the same Mango-style selector statecouchdb accepts, uses the most
+// selective indexed equality predicate (if any) to narrow the scan to a
+// single field#value prefix, and post-filters the remaining predicates in
+// Go before handing back a statedb.QueryResultsIterator.
+func (vdb *versionedDB) ExecuteQueryWithMetadata(namespace, query string, metadata map[string]interface{}) (statedb.QueryResultsIterator, error) {
+	var q richQuery
+	if err := json.Unmarshal([]byte(query), &q); err != nil {
+		return nil, errors.New("Fail to parse query selector: " + err.Error())
+	}
+	if metadata != nil {
+		if limitOption, ok := metadata[optionLimit]; ok {
+			if limit, ok := limitOption.(int32); ok {
+				q.Limit = limit
+			}
+		}
+		if bookmark, ok := metadata[optionBookmark]; ok {
+			if bookmarkKey, ok := bookmark.(string); ok {
+				q.Bookmark = bookmarkKey
+			}
+		}
+	}
+
+	candidateKeys, err := vdb.candidateKeysForSelector(namespace, q.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	// Matches are only limit-truncated as they're found when there's no
+	// sort: truncating before a requested sort is applied would silently
+	// drop rows that belonged in the final, sorted top-Limit.
+	type match struct {
+		key string
+		vv  *statedb.VersionedValue
+		doc map[string]interface{}
+	}
+	var matches []match
+	for _, key := range candidateKeys {
+		if q.Bookmark != "" && key <= q.Bookmark {
+			continue
+		}
+		vv, err := vdb.GetState(namespace, key)
+		if err != nil {
+			return nil, err
+		}
+		if vv == nil {
+			continue
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(vv.Value, &doc); err != nil {
+			continue
+		}
+		if !matchesSelector(q.Selector, doc) {
+			continue
+		}
+		matches = append(matches, match{key: key, vv: vv, doc: doc})
+		if q.Limit > 0 && len(q.Sort) == 0 && int32(len(matches)) >= q.Limit {
+			break
+		}
+	}
+
+	if len(q.Sort) > 0 {
+		sort.SliceStable(matches, func(i, j int) bool {
+			for _, field := range q.Sort {
+				vi, vj := fmt.Sprint(matches[i].doc[field]), fmt.Sprint(matches[j].doc[field])
+				if vi != vj {
+					return vi < vj
+				}
+			}
+			return false
+		})
+	}
+	if q.Limit > 0 && int32(len(matches)) > q.Limit {
+		matches = matches[:q.Limit]
+	}
+
+	results := make([]statedb.QueryResult, 0, len(matches))
+	for _, m := range matches {
+		results = append(results, &statedb.VersionedKV{
+			CompositeKey:   statedb.CompositeKey{Namespace: namespace, Key: m.key},
+			VersionedValue: *m.vv,
+		})
+	}
+	return newQueryResultsIterator(results), nil
+}
+
+// candidateKeysForSelector scans the inverted-index prefix of every
+// indexed field the selector constrains with a plain equality (either
+// `{"field": v}` or `{"field": {"$eq": v}}`), and returns the smallest of
+// those candidate sets -- the most selective one -- since any of them is a
+// correct (if not minimal) superset of the final, selector-filtered
+// result. If no selector predicate is indexed, it falls back to scanning
+// every key in the namespace, which is always correct but loses the point
+// of indexing.
+func (vdb *versionedDB) candidateKeysForSelector(ns string, selector map[string]interface{}) ([]string, error) {
+	var indexedSets [][]string
+	for _, field := range vdb.indexedFields[ns] {
+		predicate, ok := selector[field]
+		if !ok {
+			continue
+		}
+		eqVal, ok := equalityValue(predicate)
+		if !ok {
+			continue
+		}
+		keys, err := vdb.scanIndexPrefix(ns, field, eqVal)
+		if err != nil {
+			return nil, err
+		}
+		indexedSets = append(indexedSets, keys)
+	}
+	if best, ok := mostSelectiveCandidateSet(indexedSets); ok {
+		return best, nil
+	}
+
+	logger.Infof("[udb] ExecuteQuery: no indexed predicate for ns %s, falling back to full namespace scan", ns)
+	itr, err := vdb.GetStateRangeScanIterator(ns, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+	var keys []string
+	for {
+		res, err := itr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			break
+		}
+		keys = append(keys, res.(*statedb.VersionedKV).Key)
+	}
+	return keys, nil
+}
+
+// mostSelectiveCandidateSet returns the smallest of sets -- the most
+// selective indexed equality predicate's candidate keys -- since any of
+// them is a correct (if not minimal) superset of the final, selector-
+// filtered result. ok is false when sets is empty, meaning no selector
+// predicate was indexed and the caller must fall back to a full scan.
+func mostSelectiveCandidateSet(sets [][]string) (best []string, ok bool) {
+	for i, keys := range sets {
+		if i == 0 || len(keys) < len(best) {
+			best = keys
+			ok = true
+		}
+	}
+	return best, ok
+}
+
+func (vdb *versionedDB) scanIndexPrefix(ns, field string, value interface{}) ([]string, error) {
+	prefix := indexPrefix(ns, field, value)
+	dbItr := vdb.udb.GetRangeIterator(prefix, prefix+"\xff")
+	if status := dbItr.Status(); !status.Ok() && !status.IsNotFound() {
+		return nil, errors.New("Fail to scan index for ns " + ns + " field " + field + " with status " + status.ToString())
+	}
+	defer dbItr.Close()
+
+	var keys []string
+	for dbItr.Valid() {
+		keys = append(keys, strings.TrimPrefix(dbItr.Key(), prefix))
+		dbItr.Next()
+	}
+	return keys, nil
+}
+
+// equalityValue extracts the value of a plain equality predicate, either
+// `v` or `{"$eq": v}`, returning ok=false for anything richer (ranges,
+// $and/$or, regex, ...) since those can't be answered from an equality
+// index alone.
+func equalityValue(predicate interface{}) (interface{}, bool) {
+	if asMap, ok := predicate.(map[string]interface{}); ok {
+		if eq, ok := asMap["$eq"]; ok && len(asMap) == 1 {
+			return eq, true
+		}
+		return nil, false
+	}
+	return predicate, true
+}
+
+// matchesSelector evaluates the implicit-AND subset of the Mango selector
+// dialect this package supports against a decoded JSON document.
+func matchesSelector(selector map[string]interface{}, doc map[string]interface{}) bool {
+	for field, predicate := range selector {
+		if !matchesPredicate(predicate, doc[field]) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesPredicate(predicate interface{}, actual interface{}) bool {
+	asMap, ok := predicate.(map[string]interface{})
+	if !ok {
+		return fmt.Sprint(predicate) == fmt.Sprint(actual)
+	}
+	for op, operand := range asMap {
+		switch op {
+		case "$eq":
+			if fmt.Sprint(operand) != fmt.Sprint(actual) {
+				return false
+			}
+		case "$ne":
+			if fmt.Sprint(operand) == fmt.Sprint(actual) {
+				return false
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			af, aok := toFloat(actual)
+			of, ook := toFloat(operand)
+			if !aok || !ook {
+				return false
+			}
+			switch op {
+			case "$gt":
+				if !(af > of) {
+					return false
+				}
+			case "$gte":
+				if !(af >= of) {
+					return false
+				}
+			case "$lt":
+				if !(af < of) {
+					return false
+				}
+			case "$lte":
+				if !(af <= of) {
+					return false
+				}
+			}
+		default:
+			// Unrecognized operator: conservatively treat it as unmatched
+			// rather than silently dropping the predicate.
+			return false
+		}
+	}
+	return true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+// queryResultsIterator serves the materialized result set of a Mango query.
+type queryResultsIterator struct {
+	results []statedb.QueryResult
+	pos     int
+}
+
+func newQueryResultsIterator(results []statedb.QueryResult) *queryResultsIterator {
+	return &queryResultsIterator{results: results}
+}
+
+// Next implements method in statedb.ResultsIterator interface
+func (itr *queryResultsIterator) Next() (statedb.QueryResult, error) {
+	if itr.pos >= len(itr.results) {
+		return nil, nil
+	}
+	res := itr.results[itr.pos]
+	itr.pos++
+	return res, nil
+}
+
+// Close implements method in statedb.ResultsIterator interface
+func (itr *queryResultsIterator) Close() {
+	itr.pos = len(itr.results)
+}
+
+// GetBookmarkAndClose implements method in statedb.QueryResultsIterator interface
+func (itr *queryResultsIterator) GetBookmarkAndClose() string {
+	bookmark := ""
+	if len(itr.results) > 0 {
+		bookmark = itr.results[len(itr.results)-1].(*statedb.VersionedKV).Key
+	}
+	itr.Close()
+	return bookmark
+}
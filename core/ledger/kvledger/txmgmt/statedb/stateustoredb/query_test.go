@@ -0,0 +1,167 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package stateustoredb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEqualityValue(t *testing.T) {
+	if v, ok := equalityValue("bob"); !ok || v != "bob" {
+		t.Fatalf("plain equality: got (%v, %v)", v, ok)
+	}
+	if v, ok := equalityValue(map[string]interface{}{"$eq": "bob"}); !ok || v != "bob" {
+		t.Fatalf("$eq equality: got (%v, %v)", v, ok)
+	}
+	if _, ok := equalityValue(map[string]interface{}{"$gt": 5}); ok {
+		t.Fatal("$gt should not be treated as an equality predicate")
+	}
+	if _, ok := equalityValue(map[string]interface{}{"$eq": "bob", "$ne": "alice"}); ok {
+		t.Fatal("a predicate with more than one operator should not be treated as a plain equality")
+	}
+}
+
+func TestMatchesSelectorImplicitAnd(t *testing.T) {
+	selector := map[string]interface{}{"owner": "bob", "amount": map[string]interface{}{"$gte": 10.0}}
+	if !matchesSelector(selector, map[string]interface{}{"owner": "bob", "amount": 10.0}) {
+		t.Fatal("expected selector to match")
+	}
+	if matchesSelector(selector, map[string]interface{}{"owner": "alice", "amount": 10.0}) {
+		t.Fatal("expected selector not to match a different owner")
+	}
+	if matchesSelector(selector, map[string]interface{}{"owner": "bob", "amount": 5.0}) {
+		t.Fatal("expected selector not to match amount below $gte")
+	}
+}
+
+func TestIndexKeyStartsWithItsOwnPrefix(t *testing.T) {
+	key := indexKey("ns1", "owner", "bob", "asset1")
+	prefix := indexPrefix("ns1", "owner", "bob")
+	if len(key) <= len(prefix) || key[:len(prefix)] != prefix {
+		t.Fatalf("indexKey %q does not start with its own indexPrefix %q", key, prefix)
+	}
+	if suffix := key[len(prefix):]; suffix != "asset1" {
+		t.Fatalf("expected indexKey suffix to be the original key, got %q", suffix)
+	}
+}
+
+// TestIndexKeyValueContainingSeparatorDoesNotCollide pins down the chunk0-6
+// fix: a value containing the `#` separator must not produce the same
+// indexKey as a different (value, key) split of the same bytes, and a
+// prefix scan for the shorter value must not match the longer one's rows.
+func TestIndexKeyValueContainingSeparatorDoesNotCollide(t *testing.T) {
+	k1 := indexKey("ns1", "f", "a#b", "k")
+	k2 := indexKey("ns1", "f", "a", "b#k")
+	if k1 == k2 {
+		t.Fatalf("indexKey(ns,f,%q,%q) collided with indexKey(ns,f,%q,%q): %q", "a#b", "k", "a", "b#k", k1)
+	}
+
+	prefixA := indexPrefix("ns1", "f", "a")
+	keyForLongerValue := indexKey("ns1", "f", "a#b", "k")
+	if len(keyForLongerValue) >= len(prefixA) && keyForLongerValue[:len(prefixA)] == prefixA {
+		t.Fatalf("indexPrefix(ns,f,%q) = %q should not match the longer value's key %q", "a", prefixA, keyForLongerValue)
+	}
+}
+
+func TestMostSelectiveCandidateSet(t *testing.T) {
+	if _, ok := mostSelectiveCandidateSet(nil); ok {
+		t.Fatal("expected ok=false when no predicate was indexed")
+	}
+
+	best, ok := mostSelectiveCandidateSet([][]string{{"a1", "a2", "a3"}, {"b1"}, {"c1", "c2"}})
+	if !ok {
+		t.Fatal("expected ok=true when at least one indexed set is present")
+	}
+	if len(best) != 1 || best[0] != "b1" {
+		t.Fatalf("expected the smallest (most selective) candidate set {b1}, got %v", best)
+	}
+}
+
+func TestParseIndexDefinitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ustoredb-indexes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("owner.json", `{"index": {"fields": ["owner"]}, "ddoc": "indexOwnerDoc", "name": "indexOwner", "type": "json"}`)
+	write("composite.json", `{"index": {"fields": ["owner", "amount"]}}`)
+
+	fields, err := ParseIndexDefinitions(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, f := range fields {
+		seen[f] = true
+	}
+	if len(fields) != 2 || !seen["owner"] || !seen["amount"] {
+		t.Fatalf("expected deduplicated [owner amount], got %v", fields)
+	}
+}
+
+func TestParseIndexDefinitionsEmptyDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ustoredb-indexes-empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fields, err := ParseIndexDefinitions(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fields) != 0 {
+		t.Fatalf("expected no fields from an empty indexes directory, got %v", fields)
+	}
+}
+
+func TestIndexMaintenanceEntriesCore(t *testing.T) {
+	fields := []string{"owner", "amount"}
+
+	// A field's value changed: expect a delete for the old value and a put
+	// for the new one; an unchanged field produces no entries.
+	oldFields := map[string]interface{}{"owner": "alice", "amount": 10.0}
+	newDoc := map[string]interface{}{"owner": "bob", "amount": 10.0}
+	entries := indexMaintenanceEntriesCore("ns1", "asset1", fields, oldFields, newDoc, true)
+
+	var deletes, puts int
+	for _, e := range entries {
+		if e.isDelete {
+			deletes++
+			if e.compositeKey != indexKey("ns1", "owner", "alice", "asset1") {
+				t.Fatalf("unexpected delete entry: %+v", e)
+			}
+		} else {
+			puts++
+			if e.compositeKey != indexKey("ns1", "owner", "bob", "asset1") {
+				t.Fatalf("unexpected put entry: %+v", e)
+			}
+		}
+	}
+	if deletes != 1 || puts != 1 {
+		t.Fatalf("expected exactly one delete and one put for the changed field, got deletes=%d puts=%d (%+v)", deletes, puts, entries)
+	}
+
+	// A delete (hasNewDoc=false) must clean up every previously indexed field.
+	deleteEntries := indexMaintenanceEntriesCore("ns1", "asset1", fields, oldFields, nil, false)
+	if len(deleteEntries) != len(fields) {
+		t.Fatalf("expected a delete entry per previously indexed field, got %+v", deleteEntries)
+	}
+	for _, e := range deleteEntries {
+		if !e.isDelete {
+			t.Fatalf("expected every entry from a delete to be isDelete, got %+v", e)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package stateustoredb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+	"github.com/pkg/errors"
+)
+
+// rangeQueryHashDomain domain-separates range-query hashes from any other
+// use of SHA-256 in this package so the same byte sequence can never be
+// mistaken for a different kind of digest.
+var rangeQueryHashDomain = []byte("FabricSharp.RangeQueryInfo.v1")
+
+// ValidateRangeQuery MVCC-validates a range query that was read and hashed
+// at commit time into a RangeQueryInfo (StartKey, EndKey, ItrExhausted,
+// resultHash), the way Fabric's validator validates a RWSet's range
+// queries. atSnapshot identifies the snapshot the read was originally
+// taken at, but the replay below deliberately does NOT re-scan that same
+// snapshot: doing so would just recompute the hash the endorsing peer
+// already computed and trivially match, detecting nothing. Instead it
+// re-scans [startKey, endKey) against the *current* committed state --
+// i.e. every write that has landed since atSnapshot -- feeding the same
+// (key, version) pairs, in iteration order, into the same streaming hash
+// the endorsing peer used. If anything inside the range changed since
+// the read, the replayed hash diverges from expectedHash and validation
+// fails, which is the phantom-read/MVCC conflict this method exists to
+// catch. atSnapshot is also used, when exhausted is set, to tell a key
+// that already existed beyond endKey at read time (not a phantom) apart
+// from one committed since (a phantom) -- see the tail check below.
+//
+// Because the hash is a single streaming digest rather than a checkpointed
+// chain, a divergent tuple can only be detected once the whole range has
+// been replayed. The replay buffers every in-range key with its block
+// index, but not the values.
+func (vdb *versionedDB) ValidateRangeQuery(ns, startKey, endKey string, atSnapshot uint64, expectedHash []byte, exhausted bool) (bool, error) {
+	compositeStartKey := constructCompositeKey(ns, startKey)
+	compositeEndKey := namespaceEndKey(ns, endKey)
+
+	dbItr := vdb.udb.GetRangeIterator(compositeStartKey, compositeEndKey)
+	if status := dbItr.Status(); !status.Ok() && !status.IsNotFound() {
+		return false, errors.New("Fail to open range iterator to validate range query on ns " + ns + " with status " + status.ToString())
+	}
+	defer dbItr.Close()
+
+	var inRange []rangeEntry
+	for dbItr.Valid() {
+		_, key := splitCompositeKey(dbItr.Key())
+		inRange = append(inRange, rangeEntry{key: key, blkIdx: dbItr.Blk_idx()})
+		dbItr.Next()
+	}
+
+	var tail []rangeEntry
+	if exhausted {
+		tailItr := vdb.udb.GetRangeIterator(compositeEndKey, namespaceEndKey(ns, ""))
+		defer tailItr.Close()
+		for tailItr.Valid() {
+			_, key := splitCompositeKey(tailItr.Key())
+			tail = append(tail, rangeEntry{key: key, blkIdx: tailItr.Blk_idx()})
+			tailItr.Next()
+		}
+	}
+
+	return validateRangeQueryCore(inRange, tail, endKey, atSnapshot, expectedHash, exhausted), nil
+}
+
+// rangeEntry is the (key, creating-block) pair validateRangeQueryCore needs
+// out of a ustore range scan -- pulling it out of ustore's concrete
+// iterator type lets the hashing/tail-check logic below be unit tested
+// without a live ustore database.
+type rangeEntry struct {
+	key    string
+	blkIdx uint64
+}
+
+// validateRangeQueryCore is the pure decision logic behind ValidateRangeQuery:
+// inRange is every (key, blkIdx) ValidateRangeQuery's [startKey, endKey) scan
+// found at the current committed state, fed into the same streaming hash the
+// endorsing peer used; tail is every (key, blkIdx) found scanning
+// [endKey, nsEnd) (only populated when exhausted is set).
+//
+// A key in tail is only a phantom -- one that appeared in (endKey, nsEnd)
+// since the read -- when it is strictly beyond endKey (the tail scan's lower
+// bound is endKey's own composite key, which must be treated as inclusive
+// here, unlike the exclusive upper bound used for the in-range scan) AND was
+// committed after atSnapshot; a key already sitting beyond endKey at
+// atSnapshot is not a phantom, so it must not fail validation.
+func validateRangeQueryCore(inRange, tail []rangeEntry, endKey string, atSnapshot uint64, expectedHash []byte, exhausted bool) bool {
+	h := sha256.New()
+	h.Write(rangeQueryHashDomain)
+	for _, e := range inRange {
+		writeLenPrefixed(h, []byte(e.key))
+		writeLenPrefixed(h, encodeHeight(version.NewHeight(e.blkIdx, 0)))
+	}
+
+	if !bytes.Equal(h.Sum(nil), expectedHash) {
+		return false
+	}
+
+	if exhausted {
+		for _, e := range tail {
+			if e.key != endKey && e.blkIdx > atSnapshot {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// writeLenPrefixed feeds b into h as len(b)||b so that two adjacent
+// variable-length fields can never be confused with a different split of
+// the same bytes.
+func writeLenPrefixed(h interface{ Write([]byte) (int, error) }, b []byte) {
+	var lenBuf [8]byte
+	binary.LittleEndian.PutUint64(lenBuf[:], uint64(len(b)))
+	h.Write(lenBuf[:])
+	h.Write(b)
+}
+
+// encodeHeight renders a version.Height the same way on every peer,
+// independent of how version.Height may someday add fields.
+func encodeHeight(ver *version.Height) []byte {
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[0:8], ver.BlockNum)
+	binary.LittleEndian.PutUint64(buf[8:16], ver.TxNum)
+	return buf[:]
+}
@@ -0,0 +1,93 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package stateustoredb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+)
+
+func TestEncodeHeightDeterministic(t *testing.T) {
+	a := encodeHeight(version.NewHeight(5, 2))
+	b := encodeHeight(version.NewHeight(5, 2))
+	if !bytes.Equal(a, b) {
+		t.Fatal("encodeHeight should be deterministic for the same height")
+	}
+	if c := encodeHeight(version.NewHeight(5, 3)); bytes.Equal(a, c) {
+		t.Fatal("encodeHeight should differ for a different TxNum")
+	}
+}
+
+func TestWriteLenPrefixedAvoidsFieldConfusion(t *testing.T) {
+	h1 := sha256.New()
+	writeLenPrefixed(h1, []byte("ab"))
+	writeLenPrefixed(h1, []byte("c"))
+
+	h2 := sha256.New()
+	writeLenPrefixed(h2, []byte("a"))
+	writeLenPrefixed(h2, []byte("bc"))
+
+	if bytes.Equal(h1.Sum(nil), h2.Sum(nil)) {
+		t.Fatal(`writeLenPrefixed("ab","c") should not hash the same as writeLenPrefixed("a","bc")`)
+	}
+}
+
+// hashOf reproduces validateRangeQueryCore's own hash over inRange, the way
+// an endorsing peer would have computed expectedHash at simulation time.
+func hashOf(inRange []rangeEntry) []byte {
+	h := sha256.New()
+	h.Write(rangeQueryHashDomain)
+	for _, e := range inRange {
+		writeLenPrefixed(h, []byte(e.key))
+		writeLenPrefixed(h, encodeHeight(version.NewHeight(e.blkIdx, 0)))
+	}
+	return h.Sum(nil)
+}
+
+func TestValidateRangeQueryCoreDetectsHashMismatch(t *testing.T) {
+	inRange := []rangeEntry{{key: "m1", blkIdx: 1}, {key: "m2", blkIdx: 1}}
+	expectedHash := hashOf(inRange)
+
+	// A key added inside [startKey, endKey) since the read changes the
+	// in-range hash, regardless of the exhausted flag.
+	changed := []rangeEntry{{key: "m1", blkIdx: 1}, {key: "m2", blkIdx: 1}, {key: "m3", blkIdx: 2}}
+	if validateRangeQueryCore(changed, nil, "m5", 1, expectedHash, false) {
+		t.Fatal("expected validation to fail when the in-range hash no longer matches")
+	}
+	if !validateRangeQueryCore(inRange, nil, "m5", 1, expectedHash, false) {
+		t.Fatal("expected validation to pass when nothing in range changed")
+	}
+}
+
+// TestValidateRangeQueryCoreExhaustedTail pins down the chunk0-4 fix: a key
+// that already existed beyond endKey before the read (same or earlier
+// block) must not fail validation, and endKey itself reappearing in the
+// tail scan (it's the tail's inclusive lower bound) must not either. Only a
+// key strictly beyond endKey committed after atSnapshot is a phantom.
+func TestValidateRangeQueryCoreExhaustedTail(t *testing.T) {
+	inRange := []rangeEntry{{key: "m1", blkIdx: 1}}
+	expectedHash := hashOf(inRange)
+	const endKey = "m5"
+	const atSnapshot = uint64(3)
+
+	preexisting := []rangeEntry{{key: "m5", blkIdx: atSnapshot + 1}, {key: "m9", blkIdx: 1}}
+	if !validateRangeQueryCore(inRange, preexisting, endKey, atSnapshot, expectedHash, true) {
+		t.Fatal("a key that already existed beyond endKey before the read must not fail validation")
+	}
+
+	phantom := []rangeEntry{{key: "m9", blkIdx: atSnapshot + 1}}
+	if validateRangeQueryCore(inRange, phantom, endKey, atSnapshot, expectedHash, true) {
+		t.Fatal("a key committed beyond endKey after atSnapshot must fail validation as a phantom")
+	}
+
+	// exhausted=false must never consult the tail, no matter its contents.
+	if !validateRangeQueryCore(inRange, phantom, endKey, atSnapshot, expectedHash, false) {
+		t.Fatal("a non-exhausted read must not be failed by tail contents")
+	}
+}
@@ -30,17 +30,25 @@ var savePointKey = []byte{0x00}
 
 // VersionedDBProvider implements interface VersionedDBProvider
 type VersionedDBProvider struct {
+	// BatchSize bounds how many keys accumulate into one ustore.WriteBatch
+	// before ApplyUpdates submits it across the cgo boundary. Zero means
+	// defaultBatchSize.
+	BatchSize int
+	// MaxBatchBytes bounds the estimated byte size of one ustore.WriteBatch,
+	// splitting an oversized block into multiple sub-batches that still
+	// commit under a single snapshot version. Zero means defaultMaxBatchBytes.
+	MaxBatchBytes int
 }
 
 // NewVersionedDBProvider instantiates VersionedDBProvider
 func NewVersionedDBProvider() *VersionedDBProvider {
 	logger.Debug("constructing VersionedDBProvider for ustoredb")
-	return &VersionedDBProvider{}
+	return &VersionedDBProvider{BatchSize: defaultBatchSize, MaxBatchBytes: defaultMaxBatchBytes}
 }
 
 // GetDBHandle gets the handle to a named database
 func (provider *VersionedDBProvider) GetDBHandle(dbName string) (statedb.VersionedDB, error) {
-	return newVersionedDB(ustore.NewKVDB(), dbName), nil
+	return newVersionedDB(ustore.NewKVDB(), dbName, provider.BatchSize, provider.MaxBatchBytes), nil
 }
 
 // Close closes the underlying db
@@ -53,11 +61,17 @@ type versionedDB struct {
 	snapshotVersions map[uint64]string
 	udb              ustore.KVDB
 	dbName           string
+	batchSize        int
+	maxBatchBytes    int
+	// indexedFields maps a namespace to the field names declared through
+	// META-INF/statedb/ustoredb/indexes/*.json (see DeclareIndexedFields
+	// in query.go) that ApplyUpdates should maintain inverted indexes for.
+	indexedFields map[string][]string
 }
 
 // newVersionedDB constructs an instance of VersionedDB
-func newVersionedDB(udb ustore.KVDB, dbName string) *versionedDB {
-	return &versionedDB{0, make(map[uint64]string), udb, dbName}
+func newVersionedDB(udb ustore.KVDB, dbName string, batchSize int, maxBatchBytes int) *versionedDB {
+	return &versionedDB{0, make(map[uint64]string), udb, dbName, batchSize, maxBatchBytes, make(map[string][]string)}
 }
 
 // Open implements method in VersionedDB interface
@@ -125,6 +139,10 @@ func (vdb *versionedDB) ReleaseSnapshot(snapshot uint64) bool {
 func (vdb *versionedDB) GetSnapshotState(snapshot uint64, namespace string, key string) (*statedb.VersionedValue, error) {
 	logger.Infof("Get ns %s, key %s at snapshot %d", namespace, key, snapshot)
 	zeroVer := version.NewHeight(0, 0)
+	// The "_hist"/"_backward"/"_forward" suffixes below are a thin backwards-compatible
+	// adapter over ProvenanceQuerier (see provenance.go) for chaincode shims that still
+	// smuggle provenance queries through GetState. New callers should use
+	// HistoricalValue/BackwardDeps/ForwardDeps directly.
 	if strings.HasSuffix(key, "_hist") {
 		splits := strings.Split(key, "_")
 		originalKey := splits[0]
@@ -133,23 +151,22 @@ func (vdb *versionedDB) GetSnapshotState(snapshot uint64, namespace string, key
 			return nil, errors.New("Fail to parse block index from Hist Query " + key)
 		}
 
-		var histResult shim.HistResult
-		compositeKey := constructCompositeKey(namespace, originalKey)
-		if histReturn := vdb.udb.Hist(compositeKey, uint64(queriedBlkIdx)); !histReturn.Status().Ok() {
-			logger.Infof("Fail to query historical state for Key %s, at blk_idx %d with status %s",
-				compositeKey, queriedBlkIdx, histReturn.Status().ToString())
-			histResult = shim.HistResult{Msg: histReturn.Status().ToString(), Val: "", CreatedBlk: 0}
-		} else {
-			histVal := histReturn.Value()
-			height := histReturn.Blk_idx()
-			logger.Infof("ustoredb.Hist(%s, %d) = (%s, %d)", compositeKey, queriedBlkIdx, histVal, height)
-			histResult = shim.HistResult{Msg: "", Val: histVal, CreatedBlk: height}
+		result, err := vdb.HistoricalValue(namespace, originalKey, uint64(queriedBlkIdx))
+		if err != nil {
+			return nil, err
+		}
+		histResult := shim.HistResult{Val: string(result.Value), CreatedBlk: result.CreatedBlk}
+		if !result.Found {
+			histResult.Msg = result.Msg
+			if histResult.Msg == "" {
+				histResult.Msg = "not found"
+			}
 		}
-		if histJSON, err := json.Marshal(histResult); err != nil {
+		histJSON, err := json.Marshal(histResult)
+		if err != nil {
 			return nil, errors.New("Fail to marshal for HistResult")
-		} else {
-			return &statedb.VersionedValue{Version: zeroVer, Value: histJSON, Metadata: nil}, nil
 		}
+		return &statedb.VersionedValue{Version: zeroVer, Value: histJSON, Metadata: nil}, nil
 	} else if strings.HasSuffix(key, "_backward") {
 		splits := strings.Split(key, "_")
 		originalKey := splits[0]
@@ -158,29 +175,26 @@ func (vdb *versionedDB) GetSnapshotState(snapshot uint64, namespace string, key
 			return nil, errors.New("Fail to parse block index from Backward Query " + key)
 		}
 
-		var backResult shim.BackwardResult
-		compositeKey := constructCompositeKey(namespace, originalKey)
-		if backReturn := vdb.udb.Backward(compositeKey, uint64(queriedBlkIdx)); !backReturn.Status().Ok() {
-			logger.Infof("Fail to backward query for Key %s at blk_idx %d with status %d", compositeKey, queriedBlkIdx, backReturn.Status().ToString())
-
-			backResult = shim.BackwardResult{Msg: backReturn.Status().ToString(), DepKeys: nil, DepBlkIdx: nil, TxnID: ""}
-		} else {
-			depKeys := make([]string, 0)
-			depBlkIdxs := make([]uint64, 0)
-
-			for i := 0; i < int(backReturn.Dep_keys().Size()); i++ {
-				depKeys = append(depKeys, backReturn.Dep_keys().Get(i))
-				depBlkIdxs = append(depBlkIdxs, backReturn.Dep_blk_idx().Get(i))
+		result, err := vdb.BackwardDeps(namespace, originalKey, uint64(queriedBlkIdx))
+		if err != nil {
+			return nil, err
+		}
+		backResult := shim.BackwardResult{TxnID: result.TxnID}
+		if !result.Found {
+			backResult.Msg = result.Msg
+			if backResult.Msg == "" {
+				backResult.Msg = "not found"
 			}
-
-			logger.Infof("ustoredb.Backward(%s, %d) = (%v, %v)", compositeKey, queriedBlkIdx, depKeys, depBlkIdxs)
-			backResult = shim.BackwardResult{Msg: "", DepKeys: depKeys, DepBlkIdx: depBlkIdxs, TxnID: backReturn.TxnID()}
 		}
-		if backJSON, err := json.Marshal(backResult); err != nil {
+		for _, dep := range result.Deps {
+			backResult.DepKeys = append(backResult.DepKeys, constructCompositeKey(dep.Key.Namespace, dep.Key.Key))
+			backResult.DepBlkIdx = append(backResult.DepBlkIdx, dep.BlkIdx)
+		}
+		backJSON, err := json.Marshal(backResult)
+		if err != nil {
 			return nil, errors.New("Fail to marshal for backResult")
-		} else {
-			return &statedb.VersionedValue{Version: zeroVer, Value: backJSON, Metadata: nil}, nil
 		}
+		return &statedb.VersionedValue{Version: zeroVer, Value: backJSON, Metadata: nil}, nil
 	} else if strings.HasSuffix(key, "_forward") {
 		splits := strings.Split(key, "_")
 		originalKey := splits[0]
@@ -189,31 +203,27 @@ func (vdb *versionedDB) GetSnapshotState(snapshot uint64, namespace string, key
 			return nil, errors.New("Fail to parse block index from Forward Query " + key)
 		}
 
+		result, err := vdb.ForwardDeps(namespace, originalKey, uint64(queriedBlkIdx))
+		if err != nil {
+			return nil, err
+		}
 		var forwardResult shim.ForwardResult
-		compositeKey := constructCompositeKey(namespace, originalKey)
-		if forwardReturn := vdb.udb.Forward(compositeKey, uint64(queriedBlkIdx)); !forwardReturn.Status().Ok() {
-			logger.Infof("Fail to forward query for Key %s at blk_idx %d with status %d", compositeKey, queriedBlkIdx, forwardReturn.Status().ToString())
-
-			forwardResult = shim.ForwardResult{Msg: forwardReturn.Status().ToString(), ForwardKeys: nil, ForwardBlkIdx: nil, ForwardTxnIDs: nil}
-		} else {
-			forKeys := make([]string, 0)
-			forBlkIdxs := make([]uint64, 0)
-			forTxnIDs := make([]string, 0)
-
-			for i := 0; i < int(forwardReturn.Forward_keys().Size()); i++ {
-				forKeys = append(forKeys, forwardReturn.Forward_keys().Get(i))
-				forBlkIdxs = append(forBlkIdxs, forwardReturn.Forward_blk_idx().Get(i))
-				forTxnIDs = append(forTxnIDs, forwardReturn.TxnIDs().Get(i))
+		if !result.Found {
+			forwardResult.Msg = result.Msg
+			if forwardResult.Msg == "" {
+				forwardResult.Msg = "not found"
 			}
-
-			logger.Infof("ustoredb.Backward(%s, %d) = (%v, %v, %v)", compositeKey, queriedBlkIdx, forKeys, forBlkIdxs, forTxnIDs)
-			forwardResult = shim.ForwardResult{Msg: "", ForwardKeys: forKeys, ForwardBlkIdx: forBlkIdxs, ForwardTxnIDs: forTxnIDs}
 		}
-		if forwardJSON, err := json.Marshal(forwardResult); err != nil {
+		for _, dep := range result.Deps {
+			forwardResult.ForwardKeys = append(forwardResult.ForwardKeys, constructCompositeKey(dep.Key.Namespace, dep.Key.Key))
+			forwardResult.ForwardBlkIdx = append(forwardResult.ForwardBlkIdx, dep.BlkIdx)
+			forwardResult.ForwardTxnIDs = append(forwardResult.ForwardTxnIDs, dep.TxnID)
+		}
+		forwardJSON, err := json.Marshal(forwardResult)
+		if err != nil {
 			return nil, errors.New("Fail to marshal for forwardResult")
-		} else {
-			return &statedb.VersionedValue{Version: zeroVer, Value: forwardJSON, Metadata: nil}, nil
 		}
+		return &statedb.VersionedValue{Version: zeroVer, Value: forwardJSON, Metadata: nil}, nil
 	} else {
 		compositeKey := constructCompositeKey(namespace, key)
 		if histResult := vdb.udb.Hist(compositeKey, snapshot); histResult.Status().IsNotFound() {
@@ -235,59 +245,46 @@ func (vdb *versionedDB) GetSnapshotState(snapshot uint64, namespace string, key
 
 // ApplyUpdates implements method in VersionedDB interface
 func (vdb *versionedDB) ApplyUpdates(batch *statedb.UpdateBatch, height *version.Height) error {
-	// dbBatch := leveldbhelper.NewUpdateBatch()
 	namespaces := batch.GetUpdatedNamespaces()
 	logger.Infof("[udb] Prepare to commit blk %d", uint64(height.BlockNum))
+	entries := make([]writeBatchEntry, 0, len(namespaces))
 	for i, ns := range namespaces {
 		logger.Infof("[udb] Prepare to commit %d ns %s", i, ns)
 		updates := batch.GetUpdates(ns)
 		for k, vv := range updates {
-			compositeKey := constructCompositeKey(ns, k)
-			logger.Infof("[udb] ApplyUpdates: Channel [%s]: Applying key(string)=[%s] value(string)=[%s]", vdb.dbName, string(compositeKey), string(vv.Value))
-			if !strings.HasSuffix(k, "_prov") && !strings.HasSuffix(k, "_txnID") && !strings.HasSuffix(k, "_snapshot") {
-				// logger.Infof("[udb] Key %s is normal", k)
-				val := string(vv.Value)
-				depList := ustore.NewVecStr()
-				depStrs := make([]string, 0)
-				if provVal, ok := updates[k+"_prov"]; ok {
-					depKeys := strings.Split(string(provVal.Value), "_")
-					for _, depKey := range depKeys {
-						if len(depKey) > 0 {
-							depCompKey := constructCompositeKey(ns, depKey)
-							depList.Add(depCompKey)
-							depStrs = append(depStrs, depCompKey)
-						}
-					} // end for
-				} // end if provVal
-				// logger.Infof("Temp Disable for dependency...")
-				txnID := "faketxnid" // can NOT be empty
-				if txnIDVal, ok := updates[k+"_txnID"]; ok {
-					txnID = string(txnIDVal.Value)
-				}
-				var snapshotVersion string
-				var snapshot uint64
-				if snapshotVal, ok := updates[k+"_snapshot"]; ok {
-					snapshot = binary.LittleEndian.Uint64(snapshotVal.Value)
-					if snapshot == math.MaxUint64 {
-						// this could happen if the txn is update-only.
-						snapshotVersion = ""
-					} else {
-						snapshotVersion = vdb.snapshotVersions[snapshot]
+			// The "_prov"/"_txnID"/"_snapshot" sibling keys below are a thin backwards-compatible
+			// adapter that decodes a ProvEntry (see provenance.go) out of the same smuggling
+			// convention older shim helpers still write through PutState/ApplyUpdates. New
+			// callers should populate a ProvEntry and call RecordProvenance directly.
+			if strings.HasSuffix(k, "_prov") || strings.HasSuffix(k, "_txnID") || strings.HasSuffix(k, "_snapshot") {
+				logger.Infof("[udb] Key %s has special prov or txnID suffix", k)
+				continue
+			}
+			entry := ProvEntry{Snapshot: math.MaxUint64}
+			if provVal, ok := updates[k+"_prov"]; ok {
+				for _, depKey := range strings.Split(string(provVal.Value), "_") {
+					if len(depKey) > 0 {
+						entry.Deps = append(entry.Deps, KeyRef{Namespace: ns, Key: depKey})
 					}
-				} else {
-					snapshotVersion = ""
-					// 	panic(fmt.Sprintf("Fail to find the snapshot for key %s", k))
 				}
-
-				startPut := time.Now()
-				vdb.udb.PutState(compositeKey, val, txnID, height.BlockNum, depList, snapshotVersion)
-				elapsedPut := time.Since(startPut).Nanoseconds() / 1000
-				logger.Infof("[udb] PutState key [%s], val [%s], txnID [%s], blk idx [%d], dep_list [%v], snapshot=%d with %d us", compositeKey, val, txnID, height.BlockNum, depStrs, snapshot, elapsedPut)
-			} else {
-				logger.Infof("[udb] Key %s has special prov or txnID suffix", k)
-			} // end if has Suffix
+			}
+			if txnIDVal, ok := updates[k+"_txnID"]; ok {
+				entry.TxnID = string(txnIDVal.Value)
+			}
+			if snapshotVal, ok := updates[k+"_snapshot"]; ok {
+				entry.Snapshot = binary.LittleEndian.Uint64(snapshotVal.Value)
+			}
+			entries = append(entries, vdb.newWriteBatchEntry(ns, k, vv.Value, height.BlockNum, entry))
+			entries = append(entries, vdb.indexMaintenanceEntries(ns, k, vv.Value)...)
 		}
 	}
+
+	startPut := time.Now()
+	if err := vdb.applyEntries(entries); err != nil {
+		return err
+	}
+	logger.Infof("[udb] Applied %d entries for block %d in %d us", len(entries), height.BlockNum, time.Since(startPut).Nanoseconds()/1000)
+
 	blkIdx := height.BlockNum
 	startCommit := time.Now()
 	logger.Infof("[udb] Finish apply batch updates for block %d", blkIdx)
@@ -318,33 +315,96 @@ func (vdb *versionedDB) GetLatestSavePoint() (*version.Height, error) {
 }
 
 // GetStateMultipleKeys implements method in VersionedDB interface
+// It performs a single ustore round trip for the whole batch of keys
+// (one MultiGetState call) rather than issuing one state lookup per key.
 func (vdb *versionedDB) GetStateMultipleKeys(namespace string, keys []string) ([]*statedb.VersionedValue, error) {
-	return nil, errors.New("GetStateMultipleKeys not supported for ustoredb")
+	compositeKeys := ustore.NewVecStr()
+	for _, key := range keys {
+		compositeKeys.Add(constructCompositeKey(namespace, key))
+	}
+	multiResult := vdb.udb.MultiGetState(compositeKeys)
+	if status := multiResult.Status(); !status.Ok() {
+		return nil, errors.New("Fail to get multiple states for ns " + namespace + " with status " + status.ToString())
+	}
+
+	vals := make([]*statedb.VersionedValue, len(keys))
+	for i := range keys {
+		if !multiResult.Found(i) {
+			vals[i] = nil
+			continue
+		}
+		val := []byte(multiResult.Values().Get(i))
+		height := multiResult.Blk_idxs().Get(i)
+		vals[i] = &statedb.VersionedValue{Version: version.NewHeight(height, 0), Value: val, Metadata: nil}
+	}
+	logger.Infof("[udb] GetStateMultipleKeys: ns=%s, keys=%v -> %d values", namespace, keys, len(vals))
+	return vals, nil
 }
 
 // GetStateRangeScanIterator implements method in VersionedDB interface
 // startKey is inclusive
 // endKey is exclusive
 func (vdb *versionedDB) GetStateRangeScanIterator(namespace string, startKey string, endKey string) (statedb.ResultsIterator, error) {
-	return nil, errors.New("GetStateRangeScanIterator not supported for ustoredb")
-	// return vdb.GetStateRangeScanIteratorWithMetadata(namespace, startKey, endKey, nil)
+	return vdb.GetStateRangeScanIteratorWithMetadata(namespace, startKey, endKey, nil)
 }
 
 // GetStateRangeScanIteratorWithMetadata implements method in VersionedDB interface
+// It scans the ustore composite-key range [ns#startKey, ns#endKey) -- or the whole
+// namespace when endKey is empty -- and supports the same "limit"/"bookmark" pagination
+// metadata that GetStateRangeScanIteratorWithMetadata supports on statecouchdb.
 func (vdb *versionedDB) GetStateRangeScanIteratorWithMetadata(namespace string, startKey string, endKey string, metadata map[string]interface{}) (statedb.QueryResultsIterator, error) {
-	return nil, errors.New("GetStateRangeScanIteratorWithMetadata not supported for ustoredb")
-}
+	requestedLimit := int32(0)
+	if metadata != nil {
+		if limitOption, ok := metadata[optionLimit]; ok {
+			if limit, ok := limitOption.(int32); ok {
+				requestedLimit = limit
+			}
+		}
+		if bookmark, ok := metadata[optionBookmark]; ok {
+			if bookmarkKey, ok := bookmark.(string); ok && bookmarkKey != "" {
+				startKey = bookmarkKey
+			}
+		}
+	}
 
-// ExecuteQuery implements method in VersionedDB interface
-func (vdb *versionedDB) ExecuteQuery(namespace, query string) (statedb.ResultsIterator, error) {
-	return nil, errors.New("ExecuteQuery not supported for ustoredb")
-}
+	compositeStartKey := constructCompositeKey(namespace, startKey)
+	compositeEndKey := namespaceEndKey(namespace, endKey)
 
-// ExecuteQueryWithMetadata implements method in VersionedDB interface
-func (vdb *versionedDB) ExecuteQueryWithMetadata(namespace, query string, metadata map[string]interface{}) (statedb.QueryResultsIterator, error) {
-	return nil, errors.New("ExecuteQueryWithMetadata not supported for ustoredb")
+	dbItr := vdb.udb.GetRangeIterator(compositeStartKey, compositeEndKey)
+	if status := dbItr.Status(); !status.Ok() && !status.IsNotFound() {
+		return nil, errors.New("Fail to open range iterator for ns " + namespace + " with status " + status.ToString())
+	}
+	return newKVScanner(namespace, dbItr, requestedLimit), nil
 }
 
+// ExecuteQuery and ExecuteQueryWithMetadata are implemented in query.go,
+// backed by the per-field inverted indexes ApplyUpdates maintains.
+
+// metadata keys recognized by GetStateRangeScanIteratorWithMetadata and
+// ExecuteQueryWithMetadata, mirroring the ones statecouchdb accepts.
+const (
+	optionBookmark = "bookmark"
+	optionLimit    = "limit"
+)
+
 func constructCompositeKey(ns string, key string) string {
 	return ns + "#" + key
 }
+
+// splitCompositeKey is the inverse of constructCompositeKey. It assumes the
+// namespace itself never contains "#", which constructCompositeKey also assumes.
+func splitCompositeKey(compositeKey string) (ns string, key string) {
+	split := strings.SplitN(compositeKey, "#", 2)
+	return split[0], split[1]
+}
+
+// namespaceEndKey computes the exclusive upper bound of a range scan. When
+// endKey is empty the scan should cover the rest of the namespace, so the
+// bound is ns+"$" ('$' sorts right after '#'), which lies past every ns#
+// composite key, rather than ns#endKey.
+func namespaceEndKey(ns string, endKey string) string {
+	if endKey == "" {
+		return ns + "$"
+	}
+	return constructCompositeKey(ns, endKey)
+}